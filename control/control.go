@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"time"
 
 	"github.com/intelsdilabs/pulse/control/plugin"
@@ -21,10 +22,13 @@ import (
 
 const (
 	// LoadedPlugin States
-	DetectedState pluginState = "detected"
-	LoadingState  pluginState = "loading"
-	LoadedState   pluginState = "loaded"
-	UnloadedState pluginState = "unloaded"
+	DetectedState   pluginState = "detected"
+	LoadingState    pluginState = "loading"
+	LoadedState     pluginState = "loaded"
+	UnloadedState   pluginState = "unloaded"
+	RestartingState pluginState = "restarting"
+	FailedState     pluginState = "failed"
+	DisabledState   pluginState = "disabled"
 )
 
 type pluginState string
@@ -33,41 +37,105 @@ type pluginType int
 
 type loadedPlugins []LoadedPlugin
 
-type executablePlugins []ExecutablePlugin
-
 // A interface representing an executable plugin.
 type PluginExecutor interface {
 	Kill() error
 	Wait() error
 	ResponseReader() io.Reader
+	ErrorReader() io.Reader
 }
 
 // Represents a plugin loaded or loading into control
 type LoadedPlugin struct {
 	Meta       plugin.PluginMeta
 	Path       string
+	Digest     string
 	Type       plugin.PluginType
 	State      pluginState
 	Token      string
 	LoadedTime time.Time
+
+	// Client is the transport control uses to drive this plugin after
+	// its handshake succeeds (Collect/Publish/Process, Ping, Kill). Not
+	// set until the handshake succeeds.
+	Client PluginClient
+
+	// proc is the OS process backing Client, owned by Supervise once
+	// Supervise has been called for this plugin.
+	proc PluginExecutor
+	// stderr holds the last lines the plugin wrote to stderr, populated
+	// by Supervise.
+	stderr *ringBuffer
+
+	// transport and listenAddress are the handshake values Client was
+	// built from, kept so Enable and Reload can rebuild a client of the
+	// same kind without redoing the handshake.
+	transport     plugin.TransportType
+	listenAddress string
+
+	// generation counts how many times proc/Client have been swapped
+	// (initial load, each supervisor restart, each Reload), and is bumped
+	// once more by Unload so in-flight restarts back off. A supervisor
+	// goroutine captures the generation before it blocks in proc.Wait()
+	// and, once Wait() returns, compares it against the current value
+	// under registry.mu: a mismatch means Reload already retired the
+	// process it was watching, so it must not also restart it.
+	generation int
+}
+
+// RecentStderr returns the last lines the plugin wrote to stderr, as
+// drained by Supervise. It returns an empty slice if nothing has been
+// drained yet, and nil only for a LoadedPlugin with no ring buffer (one
+// not created by the registry).
+func (lp *LoadedPlugin) RecentStderr() []string {
+	if lp.stderr == nil {
+		return nil
+	}
+	return lp.stderr.snapshot()
 }
 
 type pluginControl struct {
-	// TODO, going to need coordination on changing of these
-	LoadedPlugins  loadedPlugins
-	RunningPlugins executablePlugins
-	Started        bool
+	// registry guards every LoadedPlugin known to control, whether still
+	// loading or fully loaded, and replaces the old unsynchronized
+	// LoadedPlugins slice and Started bool.
+	registry *pluginRegistry
 
 	// loadRequestsChan chan LoadedPlugin
 
 	controlPrivKey *rsa.PrivateKey
 	controlPubKey  *rsa.PublicKey
+
+	// trustPolicy is optional. When set, Load refuses to start a plugin
+	// whose detached signature is missing or does not verify against it.
+	trustPolicy *TrustPolicy
+
+	// logger aggregates every supervised plugin's stderr into control's
+	// own log, see LogSink.
+	logger *PluginLogger
+
+	// pluginLogDir is where plugins are told (via GenerateArgs) to write
+	// their own log files.
+	pluginLogDir string
+}
+
+// SetPluginLogDir overrides the directory plugins are told to write their
+// log files to via GenerateArgs. Defaults to os.TempDir().
+func (p *pluginControl) SetPluginLogDir(dir string) {
+	p.pluginLogDir = dir
+}
+
+// SetTrustPolicy installs a TrustPolicy that subsequent Load calls must
+// satisfy. Passing nil disables signature verification; a LoadOptions
+// ExpectedDigest is still enforced, and a LoadOptions
+// RequiredSignerFingerprint then makes Load fail with ErrUnsigned.
+func (p *pluginControl) SetTrustPolicy(policy *TrustPolicy) {
+	p.trustPolicy = policy
 }
 
 func (p *pluginControl) GenerateArgs(daemon bool) plugin.Arg {
 	a := plugin.Arg{
 		ControlPubKey: p.controlPubKey,
-		PluginLogPath: "/tmp",
+		PluginLogPath: p.pluginLogDir,
 		RunAsDaemon:   daemon,
 	}
 	return a
@@ -75,6 +143,9 @@ func (p *pluginControl) GenerateArgs(daemon bool) plugin.Arg {
 
 func Control() *pluginControl {
 	c := new(pluginControl)
+	c.registry = newPluginRegistry()
+	c.logger = newPluginLogger()
+	c.pluginLogDir = os.TempDir()
 	// c.loadRequestsChan = make(chan LoadedPlugin)
 	// privatekey, err := rsa.GenerateKey(rand.Reader, 4096)
 
@@ -97,25 +168,38 @@ func (p *pluginControl) Start() {
 	// a linear fashion for now as this is a low priority.
 	// go p.HandleLoadRequests()
 
-	p.Started = true
+	p.registry.mu.Lock()
+	p.registry.started = true
+	p.registry.mu.Unlock()
 }
 
 func (p *pluginControl) Stop() {
 	// close(p.loadRequestsChan)
-	p.Started = false
+	p.registry.mu.Lock()
+	p.registry.started = false
+	p.registry.mu.Unlock()
+}
+
+// started reports whether Start() has been called, without racing Load().
+func (p *pluginControl) started() bool {
+	p.registry.mu.Lock()
+	defer p.registry.mu.Unlock()
+	return p.registry.started
 }
 
-func (p *pluginControl) Load(path string) (*LoadedPlugin, error) {
-	if !p.Started {
+// Load loads the plugin at path, enforcing opts and, if set, the
+// pluginControl's TrustPolicy.
+func (p *pluginControl) Load(path string, opts LoadOptions) (*LoadedPlugin, error) {
+	if !p.started() {
 		return nil, errors.New("Must start plugin control before calling Load()")
 	}
 
 	/*
 		Loading plugin status
 
-		Before start (todo)
+		Before start
 		* executable (caught on start)
-		* signed? (todo)
+		* signed? (checked against TrustPolicy, if one is set)
 		* Grab checksum (file watching? todo)
 		=> Plugin state = detected
 
@@ -125,10 +209,56 @@ func (p *pluginControl) Load(path string) (*LoadedPlugin, error) {
 		=> Plugin state = loaded
 	*/
 
+	// claim either wins the race to load path, or blocks until whoever is
+	// already loading it finishes and hands back their result.
+	lPlugin, won := p.registry.claim(path)
+	if !won {
+		if lPlugin.State == LoadedState {
+			return lPlugin, nil
+		}
+		return nil, fmt.Errorf("plugin failed to load: %s", path)
+	}
+
 	log.Printf("Attempting to load: %s\v", path)
-	lPlugin := new(LoadedPlugin)
-	lPlugin.Path = path
-	lPlugin.State = DetectedState
+
+	digest, err := digestFile(lPlugin.Path)
+	if err != nil {
+		log.Println(err)
+		p.registry.fail(path)
+		return nil, err
+	}
+	p.registry.mutate(func() { lPlugin.Digest = digest })
+
+	if opts.ExpectedDigest != "" && opts.ExpectedDigest != lPlugin.Digest {
+		log.Printf("Digest mismatch for %s: expected %s, got %s\n", path, opts.ExpectedDigest, lPlugin.Digest)
+		p.registry.fail(path)
+		return nil, ErrDigestMismatch
+	}
+
+	if opts.RequiredSignerFingerprint != "" && p.trustPolicy == nil {
+		// A caller asking for a specific signer has no meaning without a
+		// TrustPolicy to check it against; treat that as "refuse to
+		// load", not "nothing to check, so allow it".
+		log.Printf("Signer required for %s but no TrustPolicy is configured\n", path)
+		p.registry.fail(path)
+		return nil, ErrUnsigned
+	}
+
+	if p.trustPolicy != nil {
+		signer, err := verifySignature(lPlugin.Path, p.trustPolicy)
+		if err != nil {
+			log.Println(err)
+			p.registry.fail(path)
+			return nil, err
+		}
+		if opts.RequiredSignerFingerprint != "" && opts.RequiredSignerFingerprint != signer {
+			log.Printf("Untrusted signer for %s: got %s\n", path, signer)
+			p.registry.fail(path)
+			return nil, ErrUntrustedSigner
+		}
+	}
+
+	p.registry.mutate(func() { lPlugin.State = LoadingState })
 
 	// Create a new Executable plugin
 	//
@@ -138,6 +268,7 @@ func (p *pluginControl) Load(path string) (*LoadedPlugin, error) {
 	// If error then log and return
 	if err != nil {
 		log.Println(err)
+		p.registry.fail(path)
 		return nil, err
 	}
 
@@ -145,6 +276,7 @@ func (p *pluginControl) Load(path string) (*LoadedPlugin, error) {
 	err = ePlugin.Start()
 	if err != nil {
 		log.Println(err)
+		p.registry.fail(path)
 		return nil, err
 	}
 
@@ -156,80 +288,84 @@ func (p *pluginControl) Load(path string) (*LoadedPlugin, error) {
 	// If error then we log and return
 	if err != nil {
 		log.Println(err)
+		p.registry.fail(path)
 		return nil, err
 	}
 
 	// If the response state is not Success we log an error
 	if resp.State != plugin.PluginSuccess {
 		log.Printf("Plugin loading did not succeed: %s\n", resp.ErrorMessage)
+		p.registry.fail(path)
 		return nil, errors.New(fmt.Sprintf("Plugin loading did not succeed: %s\n", resp.ErrorMessage))
 	}
-	// On response we create a LoadedPlugin
-	// and add to LoadedPlugins index
-	//
-	lPlugin.Meta = resp.Meta
-	lPlugin.Type = resp.Type
-	lPlugin.Token = resp.Token
-	lPlugin.LoadedTime = time.Now()
-	lPlugin.State = LoadedState
-
-	/*
-
-		Name
-		Version
-		Loaded Time
-
-	*/
+	client, err := newPluginClient(ePlugin, resp.Transport, resp.ListenAddress)
+	if err != nil {
+		log.Println(err)
+		p.registry.fail(path)
+		return nil, err
+	}
 
-	return lPlugin, err
+	// Populate the LoadedPlugin and promote it from its provisional path
+	// key to its permanent name:version key, all under the registry lock
+	// so nothing (List, a blocked claimant, the supervisor) ever observes
+	// it with only some of these fields set.
+	p.registry.promote(path, lPlugin, func(lp *LoadedPlugin) {
+		lp.Meta = resp.Meta
+		lp.Type = resp.Type
+		lp.Token = resp.Token
+		lp.LoadedTime = time.Now()
+		lp.State = LoadedState
+		lp.Client = client
+		lp.proc = ePlugin
+		lp.transport = resp.Transport
+		lp.listenAddress = resp.ListenAddress
+	})
+
+	return lPlugin, nil
 }
 
 // Wait for response from started ExecutablePlugin. Returns plugin.Response or error.
+// This is strictly the bootstrap handshake: once it returns successfully,
+// every further call to the plugin goes through the PluginClient Load
+// selects based on resp.Transport, not through this scanner.
 func waitForResponse(p PluginExecutor, timeout time.Duration) (*plugin.Response, error) {
-	// The response we want to return
-
-	var resp *plugin.Response = new(plugin.Response)
-	var timeoutErr error
-	var jsonErr error
-
-	// Kill on timeout
-	go func() {
-		time.Sleep(timeout)
-		timeoutErr = errors.New("Timeout waiting for response")
-		p.Kill()
-		return
-	}()
+	type result struct {
+		resp *plugin.Response
+		err  error
+	}
+	done := make(chan result, 1)
 
-	// Wait for response from ResponseReader
-	scanner := bufio.NewScanner(p.ResponseReader())
+	// Parse the handshake line on its own goroutine so a slow or silent
+	// plugin can still be timed out below; this goroutine exits on its
+	// own once ResponseReader hits EOF (on Kill or process exit), so it
+	// never outlives the call the way a bare scan-then-send would.
 	go func() {
+		scanner := bufio.NewScanner(p.ResponseReader())
 		for scanner.Scan() {
-			// Get bytes
-			b := scanner.Bytes()
-			// attempt to unmarshall into struct
-			err := json.Unmarshal(b, resp)
-			if err != nil {
-				jsonErr = errors.New("JSONError - " + err.Error())
+			resp := new(plugin.Response)
+			if err := json.Unmarshal(scanner.Bytes(), resp); err != nil {
+				done <- result{nil, errors.New("JSONError - " + err.Error())}
 				return
 			}
+			done <- result{resp, nil}
+			return
+		}
+		if err := scanner.Err(); err != nil {
+			done <- result{nil, err}
 		}
 	}()
 
-	// Wait for PluginExecutor to respond
-	err := p.Wait()
-	// Return top level error
-	if jsonErr != nil {
-		return nil, jsonErr
-	}
-	// Return top level error
-	if timeoutErr != nil {
-		return nil, timeoutErr
-	}
-	// Return pExecutor.Wait() error
-	if err != nil {
-		// log.Printf("[CONTROL] Plugin stopped with error [%v]\n", err)
-		return nil, err
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.resp, nil
+	case <-timer.C:
+		p.Kill()
+		return nil, errors.New("Timeout waiting for response")
 	}
-	// Return response
-	return resp, nil
 }
\ No newline at end of file
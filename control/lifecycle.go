@@ -0,0 +1,154 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/intelsdilabs/pulse/control/plugin"
+)
+
+// errReloadSuperseded is returned by Reload when, while it was
+// re-execing a plugin, a concurrent supervisor restart (or another
+// Reload) already bumped the plugin's generation. Reload has then already
+// discarded its freshly started process rather than clobber whatever is
+// now current, the same way errRestartSuperseded guards restart().
+var errReloadSuperseded = errors.New("plugin was restarted while it was being reloaded")
+
+// Disable moves a loaded plugin to DisabledState without removing it from
+// the registry. It is cheap: it only closes the RPC session, leaving the
+// plugin's process and registry entry alone so Enable can cheaply bring
+// it back.
+func (p *pluginControl) Disable(name, version string) error {
+	r := p.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lp, ok := r.entries[pluginKey(name, version)]
+	if !ok {
+		return fmt.Errorf("plugin not found: %s", pluginKey(name, version))
+	}
+	if lp.State != LoadedState {
+		return fmt.Errorf("cannot disable plugin %s in state %s", pluginKey(name, version), lp.State)
+	}
+
+	if lp.Client != nil {
+		if err := lp.Client.Close(); err != nil {
+			return err
+		}
+	}
+	lp.State = DisabledState
+	return nil
+}
+
+// Enable moves a disabled plugin back to LoadedState by reconnecting its
+// RPC session, without re-execing the process.
+func (p *pluginControl) Enable(name, version string) error {
+	r := p.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lp, ok := r.entries[pluginKey(name, version)]
+	if !ok {
+		return fmt.Errorf("plugin not found: %s", pluginKey(name, version))
+	}
+	if lp.State != DisabledState {
+		return fmt.Errorf("cannot enable plugin %s in state %s", pluginKey(name, version), lp.State)
+	}
+
+	client, err := newPluginClient(lp.proc, lp.transport, lp.listenAddress)
+	if err != nil {
+		return err
+	}
+	lp.Client = client
+	lp.State = LoadedState
+	return nil
+}
+
+// Reload re-execs a loaded plugin's binary and swaps in the new process
+// and client only once the new instance has passed its handshake, so an
+// in-flight caller never observes a broken plugin. The old instance is
+// drained and killed only after the swap, and the session token is
+// re-issued from the new handshake. If a supervisor restart (or another
+// Reload) installs its own replacement first, this call backs off with
+// errReloadSuperseded instead of clobbering it, mirroring the guard
+// restart() has against Reload superseding it.
+func (p *pluginControl) Reload(name, version string) error {
+	r := p.registry
+	r.mu.Lock()
+	lp, ok := r.entries[pluginKey(name, version)]
+	if !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("plugin not found: %s", pluginKey(name, version))
+	}
+	path := lp.Path
+	oldProc := lp.proc
+	oldClient := lp.Client
+	expectedGen := lp.generation
+	r.mu.Unlock()
+
+	// Start and handshake the replacement without holding the registry
+	// lock; callers keep using the old instance in the meantime.
+	newProc, err := newExecutablePlugin(p, path, false)
+	if err != nil {
+		return err
+	}
+	if err := newProc.Start(); err != nil {
+		return err
+	}
+	resp, err := waitForResponse(newProc, time.Second*3)
+	if err != nil {
+		newProc.Kill()
+		return err
+	}
+	if resp.State != plugin.PluginSuccess {
+		newProc.Kill()
+		return fmt.Errorf("plugin reload did not succeed: %s", resp.ErrorMessage)
+	}
+	newClient, err := newPluginClient(newProc, resp.Transport, resp.ListenAddress)
+	if err != nil {
+		newProc.Kill()
+		return err
+	}
+
+	r.mu.Lock()
+	if lp.State == UnloadedState {
+		// Unload() won the race while we were re-execing; don't revive it.
+		r.mu.Unlock()
+		newClient.Close()
+		newProc.Kill()
+		return fmt.Errorf("plugin %s was unloaded during reload", pluginKey(name, version))
+	}
+	if lp.generation != expectedGen {
+		// A supervisor restart (or another Reload) already installed a
+		// newer instance while we were re-execing; ours would orphan
+		// theirs, so discard it instead.
+		r.mu.Unlock()
+		newClient.Close()
+		newProc.Kill()
+		return errReloadSuperseded
+	}
+	lp.proc = newProc
+	lp.Client = newClient
+	lp.Token = resp.Token
+	lp.transport = resp.Transport
+	lp.listenAddress = resp.ListenAddress
+	lp.LoadedTime = time.Now()
+	lp.State = LoadedState
+	// Bumping generation here, before the old process is killed below, is
+	// what tells a supervisor blocked in proc.Wait() on the old process
+	// that its exit (which this Kill is about to cause) is an intentional
+	// reload rather than a crash to restart.
+	lp.generation++
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	// Drain and retire the old instance now that it's no longer reachable.
+	if oldClient != nil {
+		oldClient.Close()
+	}
+	if oldProc != nil {
+		oldProc.Kill()
+	}
+	return nil
+}
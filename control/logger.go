@@ -0,0 +1,89 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// logLevel mirrors the hclog level vocabulary snap plugins write to
+// stderr, either as a "[LEVEL]" line prefix or a JSON line with @level.
+type logLevel string
+
+const (
+	logLevelDebug logLevel = "DEBUG"
+	logLevelInfo  logLevel = "INFO"
+	logLevelWarn  logLevel = "WARN"
+	logLevelError logLevel = "ERROR"
+)
+
+// defaultStderrRingSize is how many recent stderr lines each LoadedPlugin
+// keeps, so a crash report can include the actual panic trace rather than
+// just "exit status 2".
+const defaultStderrRingSize = 100
+
+// PluginLogger multiplexes every supervised plugin's stderr into the
+// control daemon's own log, tagging each line with the plugin's name and
+// version and routing it at the level its hclog prefix (or @level JSON
+// field) indicates.
+type PluginLogger struct {
+	mu   sync.Mutex
+	sink io.Writer
+}
+
+func newPluginLogger() *PluginLogger {
+	return &PluginLogger{sink: log.Writer()}
+}
+
+// LogSink redirects the aggregated plugin log stream to w. Passing nil
+// restores the control daemon's own logger as the sink.
+func (l *PluginLogger) LogSink(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w == nil {
+		w = log.Writer()
+	}
+	l.sink = w
+}
+
+func (l *PluginLogger) write(name, version string, level logLevel, message string) {
+	l.mu.Lock()
+	w := l.sink
+	l.mu.Unlock()
+	fmt.Fprintf(w, "[%s] plugin=%s version=%s %s\n", level, name, version, message)
+}
+
+// LogSink redirects the aggregated stream of every plugin's stderr to w.
+func (p *pluginControl) LogSink(w io.Writer) {
+	p.logger.LogSink(w)
+}
+
+// parseLine extracts a level and message from a raw plugin stderr line,
+// handling both the hclog "[LEVEL] message" prefix and JSON lines
+// carrying "@level"/"@message" fields. A line that matches neither is
+// logged as-is at INFO.
+func parseLine(raw string) (logLevel, string) {
+	trimmed := strings.TrimSpace(raw)
+
+	if strings.HasPrefix(trimmed, "{") {
+		var parsed struct {
+			Level   string `json:"@level"`
+			Message string `json:"@message"`
+		}
+		if err := json.Unmarshal([]byte(trimmed), &parsed); err == nil && parsed.Message != "" {
+			return logLevel(strings.ToUpper(parsed.Level)), parsed.Message
+		}
+	}
+
+	for _, lvl := range []logLevel{logLevelDebug, logLevelInfo, logLevelWarn, logLevelError} {
+		prefix := "[" + string(lvl) + "]"
+		if strings.HasPrefix(trimmed, prefix) {
+			return lvl, strings.TrimSpace(strings.TrimPrefix(trimmed, prefix))
+		}
+	}
+
+	return logLevelInfo, trimmed
+}
@@ -0,0 +1,176 @@
+package control
+
+import (
+	"fmt"
+	"sync"
+)
+
+// pluginRegistry is the concurrency-safe store of plugins known to control,
+// keyed first by path (while a plugin is still DetectedState/LoadingState
+// and its name/version are not yet known) and then by "name:version" once
+// the handshake completes. Callers racing to load the same path block on
+// cond until the first loader finishes, rather than each starting their
+// own ExecutablePlugin.
+type pluginRegistry struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	started bool
+	entries map[string]*LoadedPlugin
+	// aliases maps a plugin's provisional path key to the canonical
+	// name:version key promote() moved it to. Without this, a claim()
+	// left blocked on path while the load it lost races promote() would
+	// wake up to find path absent from entries (promote deletes it) and
+	// create a brand new LoadedPlugin instead of observing the one that
+	// just finished loading.
+	aliases map[string]string
+}
+
+func newPluginRegistry() *pluginRegistry {
+	r := &pluginRegistry{
+		entries: make(map[string]*LoadedPlugin),
+		aliases: make(map[string]string),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+func pluginKey(name, version string) string {
+	return fmt.Sprintf("%s:%s", name, version)
+}
+
+// claim registers path as DetectedState if nothing is already loading or
+// loaded there, returning the new entry and true. If path is already
+// loading, claim blocks until that load finishes. If it was promoted,
+// claim follows the alias promote left behind and returns the finished
+// entry and false, rather than treating path as free and creating a
+// duplicate entry. If it failed, fail() has removed the entry, so claim
+// retries and may win path itself.
+func (r *pluginRegistry) claim(path string) (*LoadedPlugin, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		if existing, ok := r.entries[path]; ok {
+			if existing.State != LoadingState && existing.State != DetectedState {
+				return existing, false
+			}
+			r.cond.Wait()
+			continue
+		}
+		if canonical, ok := r.aliases[path]; ok {
+			if existing, ok := r.entries[canonical]; ok {
+				return existing, false
+			}
+			// The plugin this alias pointed to has since been
+			// unloaded; path is free to load again.
+			delete(r.aliases, path)
+		}
+		// stderr is allocated up front, not lazily by Supervise, so
+		// RecentStderr never races the pointer assignment itself.
+		lp := &LoadedPlugin{Path: path, State: DetectedState, stderr: newRingBuffer(defaultStderrRingSize)}
+		r.entries[path] = lp
+		return lp, true
+	}
+}
+
+// promote runs apply(lp) under the registry lock, then moves the plugin
+// from its provisional path key to its permanent name:version key,
+// leaves an alias from path to that key so claimants blocked on path
+// find the finished plugin instead of recreating it, and wakes any
+// blocked claimants. apply is where Load should set Meta, Type, Token,
+// Client, proc, etc. so that nothing ever observes lp with those fields
+// half-set the way an unlocked assignment followed by a locked promote
+// would allow.
+func (r *pluginRegistry) promote(path string, lp *LoadedPlugin, apply func(*LoadedPlugin)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	apply(lp)
+	lp.generation++
+	delete(r.entries, path)
+	canonical := pluginKey(lp.Meta.Name, lp.Meta.Version)
+	r.entries[canonical] = lp
+	r.aliases[path] = canonical
+	r.cond.Broadcast()
+}
+
+// fail removes the provisional entry for a load that did not succeed and
+// wakes any blocked claimants so they can retry on their own.
+func (r *pluginRegistry) fail(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.entries, path)
+	r.cond.Broadcast()
+}
+
+// mutate runs fn with the registry lock held, so callers outside this
+// file (the supervisor, Enable/Disable/Reload) can safely read or write
+// the fields of a LoadedPlugin that Lookup/List/Unload also touch.
+func (r *pluginRegistry) mutate(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn()
+}
+
+// Lookup returns the LoadedPlugin registered under name and version.
+func (p *pluginControl) Lookup(name, version string) (*LoadedPlugin, error) {
+	r := p.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lp, ok := r.entries[pluginKey(name, version)]
+	if !ok {
+		return nil, fmt.Errorf("plugin not found: %s", pluginKey(name, version))
+	}
+	return lp, nil
+}
+
+// List returns a snapshot of every plugin known to the registry, including
+// ones still loading.
+func (p *pluginControl) List() []LoadedPlugin {
+	r := p.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]LoadedPlugin, 0, len(r.entries))
+	for _, lp := range r.entries {
+		list = append(list, *lp)
+	}
+	return list
+}
+
+// Unload removes the named plugin from the registry, killing its running
+// process through its Client, or directly if no Client is attached.
+func (p *pluginControl) Unload(name, version string) error {
+	r := p.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := pluginKey(name, version)
+	lp, ok := r.entries[key]
+	if !ok {
+		return fmt.Errorf("plugin not found: %s", key)
+	}
+	// Set UnloadedState and bump generation before killing the process,
+	// so a restart() or Reload() already in flight for this plugin sees
+	// the mismatch when it tries to install its own replacement and
+	// backs off instead of resurrecting what was just unloaded.
+	lp.State = UnloadedState
+	lp.generation++
+	if lp.Client != nil {
+		if err := lp.Client.Kill(); err != nil {
+			return err
+		}
+	} else if lp.proc != nil {
+		if err := lp.proc.Kill(); err != nil {
+			return err
+		}
+	}
+	delete(r.entries, key)
+	if r.aliases[lp.Path] == key {
+		delete(r.aliases, lp.Path)
+	}
+	r.cond.Broadcast()
+	return nil
+}
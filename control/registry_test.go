@@ -0,0 +1,114 @@
+package control
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestRegistryClaimConcurrentSamePath races N goroutines calling claim on
+// the same path. Exactly one must win and create the entry; the rest must
+// block until the winner promotes it, then observe the finished,
+// fully-populated LoadedPlugin rather than a half-built one. Run with
+// -race to catch any field access that bypasses r.mu.
+func TestRegistryClaimConcurrentSamePath(t *testing.T) {
+	r := newPluginRegistry()
+	const path = "/plugins/example"
+	const goroutines = 8
+
+	var wg sync.WaitGroup
+	// claim's mutex guarantees exactly one goroutine ever takes the "not
+	// ok" branch and wins, so winners only ever needs to receive once;
+	// no timing-based synchronization is needed to know when that
+	// single send has happened.
+	winners := make(chan *LoadedPlugin)
+	losers := make(chan *LoadedPlugin, goroutines)
+
+	start := make(chan struct{})
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			lp, won := r.claim(path)
+			if won {
+				winners <- lp
+			} else {
+				losers <- lp
+			}
+		}()
+	}
+	close(start)
+
+	winner := <-winners
+
+	r.promote(path, winner, func(lp *LoadedPlugin) {
+		lp.Meta.Name = "example"
+		lp.Meta.Version = "1"
+		lp.State = LoadedState
+	})
+
+	// All remaining goroutines were blocked in cond.Wait() until promote
+	// just broadcast; wg.Wait() only returns once every one of them has
+	// woken up, claimed and sent to losers, so it's
+	// safe to close losers for ranging over right after.
+	wg.Wait()
+	close(losers)
+
+	loserCount := 0
+	for lp := range losers {
+		loserCount++
+		if lp.State != LoadedState {
+			t.Fatalf("loser observed state %q, want %q", lp.State, LoadedState)
+		}
+		if lp.Meta.Name != "example" || lp.Meta.Version != "1" {
+			t.Fatalf("loser observed partially-populated plugin: %+v", lp.Meta)
+		}
+	}
+	if loserCount != goroutines-1 {
+		t.Fatalf("expected %d losers, got %d", goroutines-1, loserCount)
+	}
+
+	if _, ok := r.entries[path]; ok {
+		t.Fatal("provisional path key should have been replaced by promote")
+	}
+	if _, ok := r.entries[pluginKey("example", "1")]; !ok {
+		t.Fatal("promoted plugin missing from registry under its name:version key")
+	}
+}
+
+// TestRegistryClaimUnblocksOnFail exercises the other side of the same
+// cond-variable contract: a claim that fails (rather than promotes) must
+// still wake blocked claimants, and one of them must then be free to win.
+func TestRegistryClaimUnblocksOnFail(t *testing.T) {
+	r := newPluginRegistry()
+	const path = "/plugins/broken"
+
+	lp, won := r.claim(path)
+	if !won {
+		t.Fatal("first claim should win")
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan bool, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, won := r.claim(path)
+		results <- won
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	r.fail(path)
+	_ = lp
+
+	wg.Wait()
+	select {
+	case won := <-results:
+		if !won {
+			t.Fatal("blocked claimant should win after the original claim failed")
+		}
+	default:
+		t.Fatal("blocked claimant never returned from claim")
+	}
+}
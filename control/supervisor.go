@@ -0,0 +1,252 @@
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intelsdilabs/pulse/control/plugin"
+)
+
+// ringBuffer keeps the last size lines written to it, discarding the
+// oldest once it is full.
+type ringBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	size  int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+func (r *ringBuffer) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines = append(r.lines, line)
+	if len(r.lines) > r.size {
+		r.lines = r.lines[len(r.lines)-r.size:]
+	}
+}
+
+func (r *ringBuffer) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]string, len(r.lines))
+	copy(out, r.lines)
+	return out
+}
+
+// SupervisorOptions configures how a supervised plugin is restarted after
+// an unexpected exit.
+type SupervisorOptions struct {
+	// MaxRestarts is the number of restarts allowed within Window before
+	// the supervisor gives up and calls OnExit.
+	MaxRestarts int
+	// Window bounds the period over which MaxRestarts is counted; restart
+	// attempts older than Window age out of the count.
+	Window time.Duration
+	// Backoff returns how long to wait before the attempt'th restart.
+	Backoff func(attempt int) time.Duration
+	// OnExit is invoked, if set, once the supervisor gives up restarting
+	// the plugin. err describes the final failure.
+	OnExit func(lp *LoadedPlugin, err error)
+}
+
+// errRestartSuperseded is returned internally by restart when, while it
+// was re-execing a crashed plugin, Reload already installed a newer
+// instance. The caller must discard its own attempt rather than clobber
+// Reload's.
+var errRestartSuperseded = errors.New("plugin was reloaded while the supervisor was restarting it")
+
+// Supervise takes ownership of lp's process for the rest of its life: it
+// drains stderr into lp's ring buffer and restarts the process on
+// unexpected exit with backoff, capped at MaxRestarts per Window. Every
+// read or write of lp's mutable fields (proc, Client, Token, State,
+// generation) goes through p.registry.mu, the same lock List, Lookup,
+// Enable, Disable and Reload use, so the supervisor can't observe, or
+// leave behind, the half-updated state an unlocked per-field access
+// would allow. The generation counter is what lets Reload hand a plugin
+// off to a new process without the supervisor mistaking the old
+// process's resulting exit for a crash and restarting on top of it.
+func (p *pluginControl) Supervise(lp *LoadedPlugin, opts SupervisorOptions) error {
+	p.registry.mu.Lock()
+	defer p.registry.mu.Unlock()
+
+	if lp.proc == nil {
+		return errors.New("cannot supervise a plugin with no attached process")
+	}
+
+	go p.superviseLoop(lp, opts)
+	return nil
+}
+
+func (p *pluginControl) superviseLoop(lp *LoadedPlugin, opts SupervisorOptions) {
+	r := p.registry
+	var restarts []time.Time
+
+	r.mu.Lock()
+	proc := lp.proc
+	gen := lp.generation
+	r.mu.Unlock()
+
+	for {
+		go drainStderr(proc.ErrorReader(), lp.stderr, p.logger, lp.Meta.Name, lp.Meta.Version)
+		exitErr := proc.Wait()
+
+		r.mu.Lock()
+		if lp.generation != gen {
+			// Reload (or a restart from a previous loop iteration)
+			// already replaced this instance; the process we were
+			// watching exiting is expected, not a crash. Pick up
+			// whatever is current and keep supervising it.
+			proc = lp.proc
+			gen = lp.generation
+			state := lp.State
+			r.mu.Unlock()
+			if state == UnloadedState || state == FailedState {
+				return
+			}
+			continue
+		}
+		if lp.State == UnloadedState {
+			// Unload() asked this process to stop; nothing to restart.
+			r.mu.Unlock()
+			return
+		}
+		if exitErr == nil {
+			r.mu.Unlock()
+			return
+		}
+		if lp.State == DisabledState {
+			// Respect the operator's choice not to run this plugin: don't
+			// auto-restart it, but surface that its process is actually
+			// gone rather than silently leaving it looking merely
+			// disabled.
+			lp.State = FailedState
+			r.mu.Unlock()
+			if opts.OnExit != nil {
+				opts.OnExit(lp, fmt.Errorf("plugin %s exited while disabled: %v", lp.Path, exitErr))
+			}
+			return
+		}
+
+		now := time.Now()
+		restarts = append(restarts, now)
+		cutoff := now.Add(-opts.Window)
+		for len(restarts) > 0 && restarts[0].Before(cutoff) {
+			restarts = restarts[1:]
+		}
+
+		if len(restarts) > opts.MaxRestarts {
+			lp.State = FailedState
+			lastOutput := lp.stderr.snapshot()
+			r.mu.Unlock()
+			if opts.OnExit != nil {
+				opts.OnExit(lp, fmt.Errorf("plugin %s exceeded %d restarts in %s: %v\nlast output:\n%s",
+					lp.Path, opts.MaxRestarts, opts.Window, exitErr, strings.Join(lastOutput, "\n")))
+			}
+			return
+		}
+
+		lp.State = RestartingState
+		r.mu.Unlock()
+
+		if opts.Backoff != nil {
+			time.Sleep(opts.Backoff(len(restarts)))
+		}
+
+		if err := p.restart(lp, gen); err != nil {
+			if err == errRestartSuperseded {
+				r.mu.Lock()
+				proc = lp.proc
+				gen = lp.generation
+				state := lp.State
+				r.mu.Unlock()
+				if state == UnloadedState || state == FailedState {
+					return
+				}
+				continue
+			}
+			r.mu.Lock()
+			lp.State = FailedState
+			r.mu.Unlock()
+			if opts.OnExit != nil {
+				opts.OnExit(lp, err)
+			}
+			return
+		}
+
+		r.mu.Lock()
+		lp.State = LoadedState
+		proc = lp.proc
+		gen = lp.generation
+		r.mu.Unlock()
+	}
+}
+
+// restart re-execs lp's binary in place, redoing the handshake and
+// swapping in the new process and client only if nothing else (Reload)
+// has already bumped lp's generation past expectedGen while this ran.
+func (p *pluginControl) restart(lp *LoadedPlugin, expectedGen int) error {
+	ePlugin, err := newExecutablePlugin(p, lp.Path, false)
+	if err != nil {
+		return err
+	}
+	if err := ePlugin.Start(); err != nil {
+		return err
+	}
+
+	resp, err := waitForResponse(ePlugin, time.Second*3)
+	if err != nil {
+		ePlugin.Kill()
+		return err
+	}
+	if resp.State != plugin.PluginSuccess {
+		ePlugin.Kill()
+		return fmt.Errorf("plugin restart did not succeed: %s", resp.ErrorMessage)
+	}
+
+	client, err := newPluginClient(ePlugin, resp.Transport, resp.ListenAddress)
+	if err != nil {
+		ePlugin.Kill()
+		return err
+	}
+
+	r := p.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if lp.generation != expectedGen {
+		// Reload got there first; our freshly started process would
+		// clobber theirs, so throw it away instead.
+		client.Close()
+		ePlugin.Kill()
+		return errRestartSuperseded
+	}
+
+	lp.Token = resp.Token
+	lp.LoadedTime = time.Now()
+	lp.Client = client
+	lp.proc = ePlugin
+	lp.transport = resp.Transport
+	lp.listenAddress = resp.ListenAddress
+	lp.generation++
+	return nil
+}
+
+// drainStderr copies lines from r into buf and, through logger, into the
+// control daemon's own log until r is closed.
+func drainStderr(r io.Reader, buf *ringBuffer, logger *PluginLogger, name, version string) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		buf.add(line)
+		level, message := parseLine(line)
+		logger.write(name, version, level, message)
+	}
+}
@@ -0,0 +1,214 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/intelsdilabs/pulse/control/plugin"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// PluginClient is implemented by every transport control can use to drive
+// a loaded plugin once its handshake has completed. waitForResponse only
+// ever negotiates the bootstrap handshake; every call afterwards (Collect,
+// Publish, Process, Ping, Kill) goes through whichever PluginClient Load
+// selected for that plugin.
+type PluginClient interface {
+	Ping() error
+	Kill() error
+	// Close tears down the RPC session (e.g. the gRPC connection) without
+	// killing the plugin's process, so Disable/Enable can toggle a
+	// plugin on and off cheaply.
+	Close() error
+	Collect(metrics []string) ([]byte, error)
+	Publish(contentType string, content []byte) error
+	Process(contentType string, content []byte) ([]byte, error)
+}
+
+// newPluginClient picks a PluginClient implementation based on the
+// Transport the plugin advertised in its handshake response.
+func newPluginClient(executor PluginExecutor, transport plugin.TransportType, listenAddress string) (PluginClient, error) {
+	switch transport {
+	case plugin.GRPCTransport:
+		return dialGRPCClient(executor, listenAddress, time.Second*3)
+	case plugin.JSONTransport, "":
+		return newJSONClient(executor), nil
+	default:
+		return nil, fmt.Errorf("unknown plugin transport: %s", transport)
+	}
+}
+
+// jsonClient is the original transport, whose only exchange with the
+// plugin is the JSON handshake on stdout. Ping succeeds without contacting
+// the plugin, Kill kills its process, and Collect, Publish and Process
+// return an error. It is used whenever a plugin does not advertise a gRPC
+// endpoint in its handshake.
+type jsonClient struct {
+	executor PluginExecutor
+}
+
+func newJSONClient(executor PluginExecutor) *jsonClient {
+	return &jsonClient{executor: executor}
+}
+
+func (c *jsonClient) Ping() error {
+	return nil
+}
+
+func (c *jsonClient) Kill() error {
+	return c.executor.Kill()
+}
+
+// Close is a no-op: the JSON transport has no session separate from the
+// plugin's own process.
+func (c *jsonClient) Close() error {
+	return nil
+}
+
+func (c *jsonClient) Collect(metrics []string) ([]byte, error) {
+	return nil, errors.New("Collect is not supported over the JSON-stdio transport")
+}
+
+func (c *jsonClient) Publish(contentType string, content []byte) error {
+	return errors.New("Publish is not supported over the JSON-stdio transport")
+}
+
+func (c *jsonClient) Process(contentType string, content []byte) ([]byte, error) {
+	return nil, errors.New("Process is not supported over the JSON-stdio transport")
+}
+
+// Method paths for the plugin gRPC service. There is no .proto for this
+// service yet (see rawCodec below), so these are just the RPC names the
+// plugin side is expected to register, in the usual
+// /package.Service/Method form.
+const (
+	grpcMethodPing    = "/snap.Plugin/Ping"
+	grpcMethodCollect = "/snap.Plugin/Collect"
+	grpcMethodPublish = "/snap.Plugin/Publish"
+	grpcMethodProcess = "/snap.Plugin/Process"
+)
+
+// rawMessage is sent and received as-is by rawCodec, letting grpcClient
+// make real RPCs against the plugin's gRPC server without a generated
+// proto message type for every call.
+type rawMessage []byte
+
+// rawCodec passes rawMessage payloads through unchanged instead of
+// encoding them as protobuf, so Collect/Publish/Process can move the
+// plugin's own content-typed payloads (whatever the plugin.PluginMeta
+// advertises) without a shared .proto definition.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(rawMessage)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: cannot marshal %T, want rawMessage", v)
+	}
+	return []byte(msg), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(*rawMessage)
+	if !ok {
+		return fmt.Errorf("rawCodec: cannot unmarshal into %T, want *rawMessage", v)
+	}
+	*msg = append((*msg)[:0], data...)
+	return nil
+}
+
+func (rawCodec) String() string {
+	return "raw"
+}
+
+// grpcClient dials the unix socket or host:port a plugin advertised in its
+// handshake response and drives every subsequent call over gRPC, which
+// unblocks streaming metrics/events the scanner-based JSON loop cannot
+// support.
+type grpcClient struct {
+	executor PluginExecutor
+	address  string
+	conn     *grpc.ClientConn
+}
+
+func dialGRPCClient(executor PluginExecutor, address string, timeout time.Duration) (*grpcClient, error) {
+	conn, err := grpc.Dial(address, grpc.WithInsecure(), grpc.WithTimeout(timeout), grpc.WithBlock(), grpc.WithCodec(rawCodec{}))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{executor: executor, address: address, conn: conn}, nil
+}
+
+// call invokes method over c.conn, sending req and returning whatever
+// bytes the plugin responds with. It is what Collect, Publish, Process
+// and Ping all route through, so they make a real RPC rather than
+// stubbing out the data plane.
+func (c *grpcClient) call(method string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	var resp rawMessage
+	if err := grpc.Invoke(ctx, method, rawMessage(req), &resp, c.conn); err != nil {
+		return nil, err
+	}
+	return []byte(resp), nil
+}
+
+func (c *grpcClient) Ping() error {
+	_, err := c.call(grpcMethodPing, nil)
+	return err
+}
+
+func (c *grpcClient) Kill() error {
+	c.conn.Close()
+	return c.executor.Kill()
+}
+
+// Close tears down the gRPC connection without killing the plugin's
+// process, so the plugin can be re-enabled with a fresh connection later.
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *grpcClient) Collect(metrics []string) ([]byte, error) {
+	req, err := encodeMetricNames(metrics)
+	if err != nil {
+		return nil, err
+	}
+	return c.call(grpcMethodCollect, req)
+}
+
+func (c *grpcClient) Publish(contentType string, content []byte) error {
+	_, err := c.call(grpcMethodPublish, prefixContentType(contentType, content))
+	return err
+}
+
+func (c *grpcClient) Process(contentType string, content []byte) ([]byte, error) {
+	return c.call(grpcMethodProcess, prefixContentType(contentType, content))
+}
+
+// encodeMetricNames joins metrics with newlines; Collect has no proto
+// message of its own (see rawCodec), so the plugin side is expected to
+// split the raw request body the same way.
+func encodeMetricNames(metrics []string) ([]byte, error) {
+	if len(metrics) == 0 {
+		return nil, errors.New("Collect requires at least one metric name")
+	}
+	joined := metrics[0]
+	for _, m := range metrics[1:] {
+		joined += "\n" + m
+	}
+	return []byte(joined), nil
+}
+
+// prefixContentType prepends contentType and a NUL separator to content,
+// giving Publish/Process's raw request body enough framing for the
+// plugin to know how to interpret what follows.
+func prefixContentType(contentType string, content []byte) []byte {
+	out := make([]byte, 0, len(contentType)+1+len(content))
+	out = append(out, []byte(contentType)...)
+	out = append(out, 0)
+	out = append(out, content...)
+	return out
+}
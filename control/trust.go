@@ -0,0 +1,105 @@
+package control
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// ErrDigestMismatch is returned when a plugin binary's computed digest
+	// does not match the digest pinned by the caller in LoadOptions.
+	ErrDigestMismatch = errors.New("plugin digest does not match expected value")
+	// ErrUnsigned is returned when a TrustPolicy is set but no .sig file
+	// could be found for the plugin binary, or when LoadOptions requires a
+	// signer but no TrustPolicy is set.
+	ErrUnsigned = errors.New("plugin is not signed")
+	// ErrUntrustedSigner is returned when a plugin's signature does not
+	// verify against any key in the TrustPolicy's authorized key set, or
+	// verifies against a key whose fingerprint was not the one required.
+	ErrUntrustedSigner = errors.New("plugin signature does not match a trusted signer")
+)
+
+// TrustPolicy controls whether a plugin binary is allowed to load based on
+// a detached signature over its content digest. When a TrustPolicy is set,
+// every plugin must have such a signature; pinning the digest itself is
+// done per call through LoadOptions. It is distinct from the control
+// keypair used to secure the plugin/control session.
+type TrustPolicy struct {
+	// AuthorizedKeys are the RSA public keys allowed to sign plugins.
+	AuthorizedKeys []*rsa.PublicKey
+	// SignatureDir is a directory containing detached `.sig` files, one
+	// per plugin binary, named "<binary basename>.sig".
+	SignatureDir string
+}
+
+// LoadOptions carries the trust constraints a caller wants enforced for a
+// single Load() call.
+type LoadOptions struct {
+	// ExpectedDigest, if set, is the lowercase hex SHA-256 digest the
+	// plugin binary must match before it is allowed to start.
+	ExpectedDigest string
+	// RequiredSignerFingerprint, if set, is the fingerprint (as computed
+	// by fingerprint: hex SHA-256 of the key's modulus and exponent) of
+	// the signer the plugin's detached signature must verify against.
+	RequiredSignerFingerprint string
+}
+
+// digestFile computes the hex-encoded SHA-256 digest of the file at path.
+func digestFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// fingerprint returns the hex SHA-256 fingerprint of an RSA public key,
+// used to identify which authorized signer produced a given signature.
+func fingerprint(pub *rsa.PublicKey) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%x:%x", pub.N, pub.E)))
+	return fmt.Sprintf("%x", h)
+}
+
+// verifySignature looks for a detached signature for path in policy's
+// SignatureDir and verifies it against policy's AuthorizedKeys. It returns
+// the fingerprint of the key that verified the signature.
+func verifySignature(path string, policy *TrustPolicy) (string, error) {
+	sigPath := filepath.Join(policy.SignatureDir, filepath.Base(path)+".sig")
+	sig, err := ioutil.ReadFile(sigPath)
+	if os.IsNotExist(err) {
+		return "", ErrUnsigned
+	}
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := digestFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return "", err
+	}
+
+	for _, pub := range policy.AuthorizedKeys {
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum, sig); err == nil {
+			return fingerprint(pub), nil
+		}
+	}
+	return "", ErrUntrustedSigner
+}
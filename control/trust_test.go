@@ -0,0 +1,110 @@
+package control
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// signFixture writes content to dir/name, signs it with priv, and writes
+// the detached signature to dir/name.sig, returning the binary's path.
+func signFixture(t *testing.T, dir, name string, content []byte, priv *rsa.PrivateKey) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0755); err != nil {
+		t.Fatalf("writing fixture: %v", err)
+	}
+
+	sum := sha256.Sum256(content)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("signing fixture: %v", err)
+	}
+	if err := ioutil.WriteFile(path+".sig", sig, 0644); err != nil {
+		t.Fatalf("writing signature: %v", err)
+	}
+	return path
+}
+
+func TestVerifySignatureTrustedSigner(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "trust-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := signFixture(t, dir, "plugin-bin", []byte("plugin binary contents"), priv)
+
+	policy := &TrustPolicy{
+		AuthorizedKeys: []*rsa.PublicKey{&priv.PublicKey},
+		SignatureDir:   dir,
+	}
+
+	signer, err := verifySignature(path, policy)
+	if err != nil {
+		t.Fatalf("verifySignature returned unexpected error: %v", err)
+	}
+	if want := fingerprint(&priv.PublicKey); signer != want {
+		t.Fatalf("verifySignature returned fingerprint %q, want %q", signer, want)
+	}
+}
+
+func TestVerifySignatureUntrustedSigner(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating signing key: %v", err)
+	}
+	authorizedKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating authorized key: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "trust-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := signFixture(t, dir, "plugin-bin", []byte("plugin binary contents"), signingKey)
+
+	policy := &TrustPolicy{
+		AuthorizedKeys: []*rsa.PublicKey{&authorizedKey.PublicKey},
+		SignatureDir:   dir,
+	}
+
+	_, err = verifySignature(path, policy)
+	if err != ErrUntrustedSigner {
+		t.Fatalf("verifySignature returned %v, want ErrUntrustedSigner", err)
+	}
+}
+
+func TestVerifySignatureUnsigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trust-test")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "plugin-bin")
+	if err := ioutil.WriteFile(path, []byte("plugin binary contents"), 0755); err != nil {
+		t.Fatalf("writing fixture: %v", err)
+	}
+
+	policy := &TrustPolicy{SignatureDir: dir}
+
+	_, err = verifySignature(path, policy)
+	if err != ErrUnsigned {
+		t.Fatalf("verifySignature returned %v, want ErrUnsigned", err)
+	}
+}